@@ -0,0 +1,78 @@
+package red
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/artyom/resp"
+)
+
+type staticAuthenticator struct {
+	password string
+}
+
+func (a staticAuthenticator) Authenticate(username, password string) error {
+	if password != a.password {
+		return errors.New("bad password")
+	}
+	return nil
+}
+
+func TestAuthGating(t *testing.T) {
+	srv := NewServer()
+	srv.WithAuthenticator(staticAuthenticator{password: "hunter2"})
+	srv.Handle("ping", func(req Request) (interface{}, error) {
+		return "PONG", nil
+	})
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { srv.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, "*1\r\n$4\r\nPING\r\n")
+	v, err := resp.Decode(r)
+	if err != nil {
+		t.Fatalf("PING before auth: %v", err)
+	}
+	if s, ok := v.(string); !ok || len(s) < 6 || s[:6] != "NOAUTH" {
+		t.Fatalf("PING before auth = %#v, want NOAUTH error", v)
+	}
+
+	fmt.Fprintf(conn, "*2\r\n$4\r\nAUTH\r\n$5\r\nwrong\r\n")
+	v, err = resp.Decode(r)
+	if err != nil {
+		t.Fatalf("bad AUTH: %v", err)
+	}
+	if s, ok := v.(string); !ok || len(s) < 9 || s[:9] != "WRONGPASS" {
+		t.Fatalf("bad AUTH = %#v, want WRONGPASS error", v)
+	}
+
+	fmt.Fprintf(conn, "*2\r\n$4\r\nAUTH\r\n$7\r\nhunter2\r\n")
+	v, err = resp.Decode(r)
+	if err != nil {
+		t.Fatalf("good AUTH: %v", err)
+	}
+	if v != "OK" {
+		t.Fatalf("good AUTH = %#v, want OK", v)
+	}
+
+	fmt.Fprintf(conn, "*1\r\n$4\r\nPING\r\n")
+	v, err = resp.Decode(r)
+	if err != nil {
+		t.Fatalf("PING after auth: %v", err)
+	}
+	if v != "PONG" {
+		t.Fatalf("PING after auth = %#v, want PONG", v)
+	}
+}
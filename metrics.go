@@ -0,0 +1,49 @@
+package red
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHist is a small HDR-style bucketed histogram of durations, used by
+// MetricsMiddleware to back Stats' LatencyP50/LatencyP99 fields. Bucket i
+// holds counts for durations in [2^(i-1)ns, 2^i ns); quantile reports the
+// upper bound of the bucket containing the requested quantile, so results
+// are accurate to a power of two rather than exact.
+type latencyHist struct {
+	buckets [64]uint64
+}
+
+func (h *latencyHist) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	b := bits.Len64(uint64(d))
+	if b >= len(h.buckets) {
+		b = len(h.buckets) - 1
+	}
+	atomic.AddUint64(&h.buckets[b], 1)
+}
+
+func (h *latencyHist) quantile(q float64) time.Duration {
+	var counts [64]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = atomic.LoadUint64(&h.buckets[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(float64(total) * q)
+	var cum uint64
+	for i, c := range counts {
+		cum += c
+		if cum > target {
+			return time.Duration(1) << uint(i)
+		}
+	}
+	last := len(counts) - 1
+	return time.Duration(1) << uint(last)
+}
@@ -0,0 +1,204 @@
+package red
+
+import "sync"
+
+// PubSub implements the channel and pattern subscriber registries backing
+// the SUBSCRIBE, PSUBSCRIBE and PUBLISH built-in commands. A Server creates
+// its PubSub lazily on first use; callers normally reach it through
+// Server.Publish and Server.PubSubStats rather than using it directly.
+type PubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+func newPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+func (p *PubSub) subscribe(channel string, sub *subscriber) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.channels[channel]
+	if m == nil {
+		m = make(map[*subscriber]struct{})
+		p.channels[channel] = m
+	}
+	m[sub] = struct{}{}
+}
+
+func (p *PubSub) unsubscribe(channel string, sub *subscriber) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.channels[channel]
+	delete(m, sub)
+	if len(m) == 0 {
+		delete(p.channels, channel)
+	}
+}
+
+func (p *PubSub) psubscribe(pattern string, sub *subscriber) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.patterns[pattern]
+	if m == nil {
+		m = make(map[*subscriber]struct{})
+		p.patterns[pattern] = m
+	}
+	m[sub] = struct{}{}
+}
+
+func (p *PubSub) punsubscribe(pattern string, sub *subscriber) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.patterns[pattern]
+	delete(m, sub)
+	if len(m) == 0 {
+		delete(p.patterns, pattern)
+	}
+}
+
+// publish delivers payload to channel subscribers and to subscribers of any
+// pattern matching channel, and returns the number of subscribers the
+// message was routed to, regardless of whether each delivery's write
+// succeeds. The registry lock is only held to snapshot the matching
+// subscribers; the (potentially blocking) network writes happen after it is
+// released, so a slow or stuck subscriber cannot stall SUBSCRIBE,
+// UNSUBSCRIBE or other publishes.
+func (p *PubSub) publish(channel string, payload []byte) int {
+	type delivery struct {
+		sub     *subscriber
+		payload []interface{}
+	}
+	p.mu.RLock()
+	deliveries := make([]delivery, 0, len(p.channels[channel]))
+	for sub := range p.channels[channel] {
+		deliveries = append(deliveries, delivery{sub, []interface{}{"message", channel, payload}})
+	}
+	for pattern, subs := range p.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			deliveries = append(deliveries, delivery{sub, []interface{}{"pmessage", pattern, channel, payload}})
+		}
+	}
+	p.mu.RUnlock()
+
+	for _, d := range deliveries {
+		d.sub.encode(d.payload)
+	}
+	return len(deliveries)
+}
+
+func (p *PubSub) stats() map[string]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]int, len(p.channels))
+	for ch, subs := range p.channels {
+		out[ch] = len(subs)
+	}
+	return out
+}
+
+// globMatch reports whether name matches pattern using Redis-style glob
+// matching: '*' matches any run of characters, '?' matches exactly one, and
+// '[...]' matches any single character in the (optionally negated with a
+// leading '^') set, with '\' escaping the next character literally.
+func globMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+			name = name[1:]
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			end := indexClassEnd(pattern)
+			if end < 0 {
+				// unterminated class, match '[' literally
+				if name[0] != '[' {
+					return false
+				}
+				name = name[1:]
+				pattern = pattern[1:]
+				continue
+			}
+			if !matchClass(pattern[1:end], name[0]) {
+				return false
+			}
+			name = name[1:]
+			pattern = pattern[end+1:]
+			continue
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			name = name[1:]
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			name = name[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(name) == 0
+}
+
+// indexClassEnd returns the index of the ']' closing the '[' class starting
+// at pattern[0], or -1 if the class is unterminated.
+func indexClassEnd(pattern string) int {
+	for i := 1; i < len(pattern); i++ {
+		if pattern[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchClass reports whether c is a member of the bracket expression class
+// (the part between '[' and ']', not including the brackets themselves).
+func matchClass(class string, c byte) bool {
+	negate := false
+	if len(class) > 0 && class[0] == '^' {
+		negate = true
+		class = class[1:]
+	}
+	match := false
+	for i := 0; i < len(class); i++ {
+		if class[i] == '-' && i > 0 && i+1 < len(class) {
+			if class[i-1] <= c && c <= class[i+1] {
+				match = true
+			}
+			i++
+			continue
+		}
+		if class[i] == c {
+			match = true
+		}
+	}
+	return match != negate
+}
@@ -3,11 +3,15 @@ package red
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/artyom/resp"
@@ -18,12 +22,52 @@ import (
 // return values of resp package types.
 type HandlerFunc func(req Request) (interface{}, error)
 
-// Request holds information about single redis command.
+// Request holds information about single redis command. The embedded
+// Context carries the values HandleConn attaches to every command it
+// dispatches (remote address, connection id, whether it's running as part
+// of a transaction replay); retrieve them with RemoteAddr, ConnID and InTx.
+// Existing code that builds a HandlerFunc is unaffected: Request grew a
+// field, the signature of HandlerFunc did not change.
 type Request struct {
+	context.Context
 	Name string   // lowercase command itself (first word)
 	Args []string // command arguments
 }
 
+// Middleware wraps a HandlerFunc with additional behavior, such as logging
+// or metrics collection. Use Server.Use to install one.
+type Middleware func(HandlerFunc) HandlerFunc
+
+type ctxKey int
+
+const (
+	ctxKeyRemoteAddr ctxKey = iota
+	ctxKeyConnID
+	ctxKeyInTx
+)
+
+// RemoteAddr returns the remote address of the connection that produced
+// ctx, or "" if ctx did not originate from a Request or conn has none.
+func RemoteAddr(ctx context.Context) string {
+	v, _ := ctx.Value(ctxKeyRemoteAddr).(string)
+	return v
+}
+
+// ConnID returns the per-connection identifier of the connection that
+// produced ctx. IDs are assigned sequentially starting at 1 as connections
+// are accepted by a given Server.
+func ConnID(ctx context.Context) uint64 {
+	v, _ := ctx.Value(ctxKeyConnID).(uint64)
+	return v
+}
+
+// InTx reports whether ctx belongs to a command run as part of a
+// MULTI/EXEC transaction replay, as opposed to one dispatched directly.
+func InTx(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyInTx).(bool)
+	return v
+}
+
 // NewServer returns initialized server.
 func NewServer() *Server {
 	return &Server{log: noopLogger{}}
@@ -36,6 +80,54 @@ func (s *Server) WithLogger(l Logger) {
 	}
 }
 
+// WithTLSConfig configures the TLS configuration used by ListenAndServeTLS
+// as the base config, to which the certificate/key pair passed to it is
+// added. ServeTLS does not use it and uses only the config passed to it. Set
+// ClientCAs and ClientAuth on cfg to require and verify client certificates
+// (mutual TLS).
+func (s *Server) WithTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// WithAuthenticator configures server to require clients to authenticate
+// with the AUTH command before running any other command. Once set, every
+// connection starts unauthenticated and handlers are only reached after a
+// successful AUTH call.
+func (s *Server) WithAuthenticator(a Authenticator) {
+	s.authenticator = a
+}
+
+// Authenticator validates credentials supplied with the AUTH command.
+// Username is empty for the pre-6.0 "AUTH password" form, mirroring Redis
+// ACL semantics where a username is optional.
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
+// WithKeyVersioner configures the server to use kv to back WATCH/EXEC
+// optimistic-locking transactions. Without one configured, WATCH reports an
+// error instead of silently never detecting a conflict.
+func (s *Server) WithKeyVersioner(kv KeyVersioner) {
+	s.keyVersioner = kv
+}
+
+// KeyVersioner is implemented by user storage to back WATCH/EXEC
+// optimistic-locking transactions: EXEC re-checks every watched key's
+// version and discards the queued commands if any of them changed, instead
+// of serializing all transactions behind a single server-wide lock.
+// Version and Bump must be safe for concurrent use; the server never
+// serializes calls to them, so unrelated transactions can run in parallel.
+// Handlers that mutate state are expected to call Bump on every key they
+// change, typically by closing over the same storage passed here.
+type KeyVersioner interface {
+	// Version returns key's current version. It may return any value for
+	// a key that doesn't exist, as long as the value changes whenever the
+	// key is created, modified or deleted.
+	Version(key string) uint64
+	// Bump increments the version of each of the given keys.
+	Bump(keys ...string)
+}
+
 // Handle registers handler for command with given name (case-insensitive)
 func (s *Server) Handle(name string, h HandlerFunc) {
 	if name == "" {
@@ -45,116 +137,704 @@ func (s *Server) Handle(name string, h HandlerFunc) {
 		panic("Handle called with nil HandlerFunc")
 	}
 	if s.handlers == nil {
-		s.handlers = make(map[string]HandlerFunc)
+		s.handlers = make(map[string]cmdHandler)
+	}
+	key := strings.ToLower(name)
+	idx, ok := len(s.cmdCount), false
+	if old, exists := s.handlers[key]; exists {
+		idx, ok = old.idx, true
+	}
+	if !ok {
+		s.cmdCount = append(s.cmdCount, 0)
+		s.cmdLatency = append(s.cmdLatency, new(latencyHist))
+	}
+	s.handlers[key] = cmdHandler{idx: idx, fn: h}
+}
+
+// Use appends middleware to the server's chain. Middleware wraps every
+// registered handler, including replays of queued MULTI/EXEC commands, in
+// the order it was added: the first middleware passed to Use sees the
+// request first and its reply last.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// WithSlogger configures the logger used by LoggingMiddleware. It is the
+// preferred alternative to the stringly-typed Logger interface accepted by
+// WithLogger. The server's own operational messages, such as Accept errors,
+// still go to the Logger set with WithLogger.
+func (s *Server) WithSlogger(l *slog.Logger) {
+	s.slog = l
+}
+
+// cmdHandler pairs a registered HandlerFunc with its index into
+// Server.cmdCount/cmdLatency, used by Stats.
+type cmdHandler struct {
+	idx int
+	fn  HandlerFunc
+}
+
+// wrap applies the middleware chain installed with Use around h.
+func (s *Server) wrap(h HandlerFunc) HandlerFunc {
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
+
+// runHandler counts the call toward Stats and runs h.fn, wrapped with any
+// middleware installed via Use, returning the value to pass to resp.Encode.
+func (s *Server) runHandler(h cmdHandler, r Request) interface{} {
+	atomic.AddUint64(&s.cmdCount[h.idx], 1)
+	return singleVal(s.wrap(h.fn), r)
+}
+
+// CmdCount describes the number of times a particular command was
+// processed, and, when MetricsMiddleware is installed, its observed
+// latency distribution.
+type CmdCount struct {
+	Name       string
+	Cnt        int
+	LatencyP50 time.Duration
+	LatencyP99 time.Duration
+}
+
+// Stats returns statistics about the number of known command calls
+// processed since the previous Stats call. LatencyP50/LatencyP99 are only
+// populated for commands whose latency was recorded by MetricsMiddleware.
+func (s *Server) Stats() []CmdCount {
+	out := make([]CmdCount, len(s.cmdCount))
+	for name, h := range s.handlers {
+		out[h.idx] = CmdCount{
+			Name:       name,
+			Cnt:        int(atomic.SwapUint64(&s.cmdCount[h.idx], 0)),
+			LatencyP50: s.cmdLatency[h.idx].quantile(0.50),
+			LatencyP99: s.cmdLatency[h.idx].quantile(0.99),
+		}
+	}
+	return out
+}
+
+// MetricsMiddleware returns a Middleware that records each call's latency
+// into the histogram Stats reports via LatencyP50/LatencyP99. Install it
+// with Use; call counts in Stats are tracked regardless.
+func (s *Server) MetricsMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r Request) (interface{}, error) {
+			start := time.Now()
+			v, err := next(r)
+			if h, ok := s.handlers[r.Name]; ok {
+				s.cmdLatency[h.idx].observe(time.Since(start))
+			}
+			return v, err
+		}
+	}
+}
+
+// LoggingMiddleware returns a Middleware that emits one slog record per
+// command via the logger configured with WithSlogger, with fields cmd,
+// args_len, duration, remote_addr, err and tx. Commands are passed through
+// unmodified if no logger is configured.
+func (s *Server) LoggingMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r Request) (interface{}, error) {
+			if s.slog == nil {
+				return next(r)
+			}
+			start := time.Now()
+			v, err := next(r)
+			s.slog.Info("command",
+				"cmd", r.Name,
+				"args_len", len(r.Args),
+				"duration", time.Since(start),
+				"remote_addr", RemoteAddr(r.Context),
+				"err", err,
+				"tx", InTx(r.Context),
+			)
+			return v, err
+		}
 	}
-	s.handlers[strings.ToLower(name)] = h
 }
 
 // Server implements server speaking RESP (REdis Serialization Protocol). Server
 // automatically handles MULTI & EXEC commands for transactions, QUIT for
-// client-initiated disconnect, other commands are expected to be implemented
-// separately and registered with Handle method.
+// client-initiated disconnect, AUTH, WATCH/UNWATCH, CLIENT, RESET and the
+// pub/sub commands (see HandleConn), other commands are expected to be
+// implemented separately and registered with Handle method.
 type Server struct {
-	log      Logger
-	handlers map[string]HandlerFunc
-	mu       sync.Mutex // used to serialize transactions
+	log           Logger
+	handlers      map[string]cmdHandler
+	tlsConfig     *tls.Config
+	authenticator Authenticator
+	keyVersioner  KeyVersioner
+	middleware    []Middleware
+	slog          *slog.Logger
+	cmdCount      []uint64
+	cmdLatency    []*latencyHist
+	nextConnID    uint64
+
+	// ReadTimeout is the maximum duration for reading a single command.
+	// It is reset after every command. Zero means no timeout.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration for writing a single reply.
+	// It is reset after every reply. Zero means no timeout.
+	WriteTimeout time.Duration
+	// IdleTimeout, if set, overrides ReadTimeout while waiting for the
+	// next command on an otherwise idle connection.
+	IdleTimeout time.Duration
+	// DialKeepAlive is the TCP keep-alive period set on connections
+	// accepted by ListenAndServe and ListenAndServeTLS; Serve and ServeTLS
+	// leave keep-alive to the listener passed to them. Zero uses a default
+	// of 3 minutes.
+	DialKeepAlive time.Duration
+	// TCPReadBuffer and TCPWriteBuffer, when non-zero, set the
+	// corresponding socket buffer sizes on accepted connections that are
+	// *net.TCPConn. Connections served through ServeTLS or
+	// ListenAndServeTLS are *tls.Conn and are not affected.
+	TCPReadBuffer  int
+	TCPWriteBuffer int
+	// MaxConns limits the number of simultaneously served connections.
+	// Accepted connections beyond this limit block until a slot frees
+	// up. Zero means unlimited.
+	MaxConns int
+
+	shutdownMu sync.Mutex // guards done and listeners
+	done       chan struct{}
+	listeners  map[net.Listener]struct{}
+	conns      sync.Map // io.ReadWriteCloser -> *connState
+
+	psOnce sync.Once
+	pubsub *PubSub
+}
+
+// pubSub returns the server's PubSub instance, creating it on first use.
+func (s *Server) pubSub() *PubSub {
+	s.psOnce.Do(func() { s.pubsub = newPubSub() })
+	return s.pubsub
+}
+
+// Publish delivers payload to every connection subscribed to channel,
+// directly or through a matching PSUBSCRIBE pattern, and returns the number
+// of deliveries attempted: a connection is counted once for the channel and
+// once for every matching pattern it subscribed to, and deliveries whose
+// write fails are counted too.
+func (s *Server) Publish(channel string, payload []byte) int {
+	return s.pubSub().publish(channel, payload)
+}
+
+// PubSubStats returns, for every channel with at least one subscriber, the
+// number of connections subscribed to it via SUBSCRIBE. Pattern
+// subscriptions are not broken down per channel.
+func (s *Server) PubSubStats() map[string]int {
+	return s.pubSub().stats()
+}
+
+// ErrServerClosed is returned by Serve, ListenAndServe and ListenAndServeTLS
+// after Shutdown or Close has been called.
+var ErrServerClosed = errors.New("red: Server closed")
+
+// connState holds per-connection state threaded through HandleConn: whether
+// a connection registered with Server is currently executing a command
+// (busy) or waiting for the next one (idle), so Shutdown can close idle
+// connections immediately while letting busy ones, including an in-progress
+// MULTI/EXEC replay, finish; and the name assigned with CLIENT SETNAME,
+// reported back by CLIENT GETNAME.
+type connState struct {
+	conn io.Closer
+	mu   sync.Mutex
+	busy bool
+	name string
+}
+
+// subscriber represents a connection's pub/sub endpoint: encode serializes a
+// value onto that connection, synchronized against the connection's own
+// command replies so a PUBLISH delivered from another goroutine cannot
+// interleave with an in-progress write.
+type subscriber struct {
+	encode func(v interface{}) error
+}
+
+func (cs *connState) setBusy(busy bool) {
+	cs.mu.Lock()
+	cs.busy = busy
+	cs.mu.Unlock()
+}
+
+func (cs *connState) isBusy() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.busy
+}
+
+func (cs *connState) setName(name string) {
+	cs.mu.Lock()
+	cs.name = name
+	cs.mu.Unlock()
+}
+
+func (cs *connState) getName() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.name
+}
+
+func (s *Server) shutdownChan() <-chan struct{} {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	return s.done
+}
+
+// markShuttingDown lazily creates and closes the done channel, returning the
+// set of currently registered listeners.
+func (s *Server) markShuttingDown() []net.Listener {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	lns := make([]net.Listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		lns = append(lns, l)
+	}
+	return lns
+}
+
+func (s *Server) trackListener(l net.Listener) {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isShuttingDown() bool {
+	select {
+	case <-s.shutdownChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// closeIdleConns closes every registered connection not currently executing
+// a command and returns the number of connections still busy.
+func (s *Server) closeIdleConns() (busy int) {
+	s.conns.Range(func(key, value interface{}) bool {
+		cs := value.(*connState)
+		if cs.isBusy() {
+			busy++
+			return true
+		}
+		cs.conn.Close()
+		s.conns.Delete(key)
+		return true
+	})
+	return busy
+}
+
+func (s *Server) closeAllConns() {
+	s.conns.Range(func(key, value interface{}) bool {
+		value.(*connState).conn.Close()
+		s.conns.Delete(key)
+		return true
+	})
+}
+
+// Shutdown gracefully shuts the server down: it stops accepting new
+// connections, closes idle ones immediately, and waits for busy
+// connections (including one completing a MULTI/EXEC transaction) to
+// finish their current command. If ctx is done before all connections
+// finish, the remaining ones are force-closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	for _, l := range s.markShuttingDown() {
+		l.Close()
+	}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if busy := s.closeIdleConns(); busy == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server immediately: it stops accepting new connections
+// and force-closes every connection currently served, without waiting for
+// in-flight commands to finish.
+func (s *Server) Close() error {
+	var err error
+	for _, l := range s.markShuttingDown() {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.closeAllConns()
+	return err
 }
 
 // HandleConn processes single client connection, automatically handling
-// following commands MULTI/EXEC (transactions), QUIT (client disconnect). It
-// calls user-provided handlers for registered commands.
+// following commands: MULTI/EXEC (transactions), WATCH/UNWATCH (optimistic
+// locking, when a KeyVersioner is configured via WithKeyVersioner),
+// CLIENT GETNAME/SETNAME/ID, RESET, QUIT (client disconnect),
+// SUBSCRIBE/UNSUBSCRIBE/PSUBSCRIBE/PUNSUBSCRIBE/PUBLISH (pub/sub), and AUTH
+// (checked against the Authenticator configured via WithAuthenticator, or
+// answered with an error if there is none). It calls user-provided handlers
+// for registered commands.
 func (s *Server) HandleConn(conn io.ReadWriteCloser) error {
 	defer conn.Close()
 	rd := bufio.NewReader(conn)
+	dc, _ := conn.(deadlineSetter)
+	var writeMu sync.Mutex // also guards writes from asynchronous PUBLISH delivery
+	encode := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if dc != nil && s.WriteTimeout > 0 {
+			dc.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		}
+		return resp.Encode(conn, v)
+	}
+	cs := &connState{conn: conn}
+	s.conns.Store(conn, cs)
+	defer s.conns.Delete(conn)
+	connID := atomic.AddUint64(&s.nextConnID, 1)
+	var remoteAddr string
+	if rc, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		remoteAddr = rc.RemoteAddr().String()
+	}
+	baseCtx := context.WithValue(context.WithValue(context.Background(),
+		ctxKeyRemoteAddr, remoteAddr), ctxKeyConnID, connID)
+	txCtx := context.WithValue(baseCtx, ctxKeyInTx, true)
+	sub := &subscriber{encode: encode}
+	subscribed := make(map[string]bool)
+	psubscribed := make(map[string]bool)
+	defer func() {
+		for name := range subscribed {
+			s.pubSub().unsubscribe(name, sub)
+		}
+		for name := range psubscribed {
+			s.pubSub().punsubscribe(name, sub)
+		}
+	}()
 	var tx []Request
-	var inTx bool  // if we're inside transaction
-	var errTx bool // true if transaction seen error and should be discarded
+	var inTx bool                 // if we're inside transaction
+	var errTx bool                // true if transaction seen error and should be discarded
+	var watched map[string]uint64 // key -> version snapshotted by WATCH
 	var err error
+	authenticated := s.authenticator == nil
 	for {
 		if err != nil {
 			return err
 		}
-		req, err := resp.DecodeRequest(rd)
-		switch err {
+		cs.setBusy(false)
+		select {
+		case <-s.shutdownChan():
+			return nil
+		default:
+		}
+		if dc != nil {
+			if s.IdleTimeout > 0 {
+				// IdleTimeout only bounds the wait for the next command to
+				// start; once its first byte has arrived, switch to
+				// ReadTimeout for reading the rest of it.
+				dc.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+				if _, err := rd.Peek(1); err != nil {
+					return err
+				}
+			}
+			if timeout := s.ReadTimeout; timeout > 0 {
+				dc.SetReadDeadline(time.Now().Add(timeout))
+			} else if s.IdleTimeout > 0 {
+				dc.SetReadDeadline(time.Time{})
+			}
+		}
+		req, derr := resp.DecodeRequest(rd)
+		switch derr {
 		case nil:
+			cs.setBusy(true)
 		case resp.ErrInvalidRequest:
-			err = resp.Encode(conn, resp.Error("ERR unknown command"))
+			err = encode(resp.Error("ERR unknown command"))
 			continue
 		default:
-			return err
+			return derr
 		}
 		cmd := strings.ToLower(req[0])
+		if !authenticated && cmd != "auth" && cmd != "quit" && cmd != "reset" {
+			err = encode(resp.Error("NOAUTH Authentication required."))
+			continue
+		}
+		if len(subscribed)+len(psubscribed) > 0 {
+			switch cmd {
+			case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ping", "quit", "reset", "publish":
+			default:
+				err = encode(resp.Error("ERR Can't execute '" + cmd + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET / PUBLISH are allowed in this context"))
+				continue
+			}
+		}
 		switch cmd {
 		case "quit":
 			return nil
+		case "subscribe", "psubscribe":
+			if len(req) < 2 {
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			pattern := cmd == "psubscribe"
+			reply := cmd
+			for _, name := range req[1:] {
+				set := subscribed
+				if pattern {
+					set = psubscribed
+				}
+				if !set[name] {
+					set[name] = true
+					if pattern {
+						s.pubSub().psubscribe(name, sub)
+					} else {
+						s.pubSub().subscribe(name, sub)
+					}
+				}
+				werr := encode(resp.Array{reply, name, int64(len(subscribed) + len(psubscribed))})
+				if werr != nil {
+					err = werr
+				}
+			}
+			continue
+		case "unsubscribe", "punsubscribe":
+			pattern := cmd == "punsubscribe"
+			set := subscribed
+			if pattern {
+				set = psubscribed
+			}
+			names := req[1:]
+			if len(names) == 0 {
+				for name := range set {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				err = encode(resp.Array{cmd, nil, int64(len(subscribed) + len(psubscribed))})
+				continue
+			}
+			for _, name := range names {
+				if set[name] {
+					delete(set, name)
+					if pattern {
+						s.pubSub().punsubscribe(name, sub)
+					} else {
+						s.pubSub().unsubscribe(name, sub)
+					}
+				}
+				werr := encode(resp.Array{cmd, name, int64(len(subscribed) + len(psubscribed))})
+				if werr != nil {
+					err = werr
+				}
+			}
+			continue
+		case "publish":
+			if len(req) != 3 {
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			err = encode(int64(s.Publish(req[1], []byte(req[2]))))
+			continue
+		case "auth":
+			if s.authenticator == nil {
+				err = encode(resp.Error("ERR Client sent AUTH, but no password is set."))
+				continue
+			}
+			var username, password string
+			switch len(req) {
+			case 2:
+				password = req[1]
+			case 3:
+				username, password = req[1], req[2]
+			default:
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			if authErr := s.authenticator.Authenticate(username, password); authErr != nil {
+				err = encode(resp.Error("WRONGPASS invalid username-password pair or user is disabled."))
+				continue
+			}
+			authenticated = true
+			err = encode(resp.OK)
+			continue
+		case "watch":
+			if len(req) < 2 {
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			if inTx {
+				errTx = true
+				err = encode(resp.Error("ERR WATCH inside MULTI is not allowed"))
+				continue
+			}
+			if s.keyVersioner == nil {
+				err = encode(resp.Error("ERR WATCH is not supported: no KeyVersioner configured"))
+				continue
+			}
+			if watched == nil {
+				watched = make(map[string]uint64, len(req)-1)
+			}
+			for _, key := range req[1:] {
+				watched[key] = s.keyVersioner.Version(key)
+			}
+			err = encode(resp.OK)
+			continue
+		case "unwatch":
+			if len(req) != 1 {
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			watched = nil
+			err = encode(resp.OK)
+			continue
+		case "client":
+			if len(req) < 2 {
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			switch sub := strings.ToLower(req[1]); sub {
+			case "getname":
+				if len(req) != 2 {
+					err = encode(errWrongArgs(cmd))
+					continue
+				}
+				err = encode(cs.getName())
+			case "setname":
+				if len(req) != 3 {
+					err = encode(errWrongArgs(cmd))
+					continue
+				}
+				if strings.IndexFunc(req[2], func(r rune) bool { return r < '!' || r > '~' }) >= 0 {
+					err = encode(resp.Error("ERR Client names cannot contain spaces, newlines or special characters."))
+					continue
+				}
+				cs.setName(req[2])
+				err = encode(resp.OK)
+			case "id":
+				if len(req) != 2 {
+					err = encode(errWrongArgs(cmd))
+					continue
+				}
+				err = encode(int64(connID))
+			default:
+				err = encode(resp.Error("ERR Unknown CLIENT subcommand or wrong number of arguments for '" + req[1] + "'"))
+			}
+			continue
+		case "reset":
+			if len(req) != 1 {
+				err = encode(errWrongArgs(cmd))
+				continue
+			}
+			inTx, errTx = false, false
+			tx = tx[:0]
+			watched = nil
+			for name := range subscribed {
+				s.pubSub().unsubscribe(name, sub)
+				delete(subscribed, name)
+			}
+			for name := range psubscribed {
+				s.pubSub().punsubscribe(name, sub)
+				delete(psubscribed, name)
+			}
+			cs.setName("")
+			authenticated = s.authenticator == nil
+			err = encode(resp.SimpleString("RESET"))
+			continue
 		case "multi":
 			if len(req) != 1 {
 				if inTx {
 					errTx = true
 				}
-				err = resp.Encode(conn, errWrongArgs(cmd))
+				err = encode(errWrongArgs(cmd))
 				continue
 			}
 			if inTx {
 				errTx = true
-				err = resp.Encode(conn, resp.Error("ERR MULTI calls can not be nested"))
+				err = encode(resp.Error("ERR MULTI calls can not be nested"))
 				continue
 			}
 			inTx, errTx = true, false
-			err = resp.Encode(conn, resp.OK)
+			err = encode(resp.OK)
 			continue
 		case "exec":
 			if len(req) != 1 {
 				if inTx {
 					errTx = true
 				}
-				err = resp.Encode(conn, errWrongArgs(cmd))
+				err = encode(errWrongArgs(cmd))
 				continue
 			}
 			if !inTx {
-				err = resp.Encode(conn, resp.Error("ERR EXEC without MULTI"))
+				err = encode(resp.Error("ERR EXEC without MULTI"))
 				continue
 			}
 			if errTx {
 				inTx, errTx = false, false
 				tx = tx[:0]
-				err = resp.Encode(conn, resp.Error("EXECABORT Transaction discarded because of previous errors."))
+				watched = nil
+				err = encode(resp.Error("EXECABORT Transaction discarded because of previous errors."))
 				continue
 			}
+			if !watchStillValid(s.keyVersioner, watched) {
+				inTx, errTx = false, false
+				tx = tx[:0]
+				watched = nil
+				err = encode(resp.Array(nil))
+				continue
+			}
+			watched = nil
 		default:
 			h, ok := s.handlers[cmd]
 			if !ok {
 				if inTx {
 					errTx = true
 				}
-				err = resp.Encode(conn, errNoCmd(cmd))
+				err = encode(errNoCmd(cmd))
 				continue
 			}
 			if inTx {
 				if !errTx {
-					tx = append(tx, Request{Name: cmd, Args: req[1:]})
+					tx = append(tx, Request{Context: txCtx, Name: cmd, Args: req[1:]})
 				}
-				err = resp.Encode(conn, resp.SimpleString("QUEUED"))
+				err = encode(resp.SimpleString("QUEUED"))
 				continue
 			}
-			err = resp.Encode(conn, singleVal(h, Request{Name: cmd, Args: req[1:]}))
+			err = encode(s.runHandler(h, Request{Context: baseCtx, Name: cmd, Args: req[1:]}))
 			continue
 		}
 
 		txReplies := make(resp.Array, 0, len(tx))
-		s.mu.Lock()
 		for _, r := range tx {
 			h, ok := s.handlers[r.Name]
 			if !ok {
 				txReplies = append(txReplies, errNoCmd(r.Name))
 				continue
 			}
-			txReplies = append(txReplies, singleVal(h, r))
+			txReplies = append(txReplies, s.runHandler(h, r))
 		}
-		s.mu.Unlock()
 		inTx, errTx = false, false
 		tx = tx[:0]
-		err = resp.Encode(conn, txReplies)
+		err = encode(txReplies)
 	}
 }
 
@@ -165,19 +845,90 @@ func (s *Server) ListenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
-	return s.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+	return s.Serve(tcpKeepAliveListener{ln.(*net.TCPListener), s.DialKeepAlive})
+}
+
+// ListenAndServeTLS listens on TCP network address addr and then calls
+// ServeTLS to handle requests on incoming TLS connections. certFile and
+// keyFile are used as the server certificate; additional TLS settings (such
+// as ClientCAs/ClientAuth for mutual TLS) can be supplied with
+// WithTLSConfig.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := s.tlsConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(tcpKeepAliveListener{ln.(*net.TCPListener), s.DialKeepAlive}, cfg)
+}
+
+// ServeTLS wraps l with TLS using cfg and calls Serve to handle requests on
+// incoming connections.
+func (s *Server) ServeTLS(l net.Listener, cfg *tls.Config) error {
+	return s.Serve(tls.NewListener(l, cfg))
 }
 
 // Serve accepts incoming connections on the Listener l, creating a new service
-// goroutine for each.
+// goroutine for each. Accepts beyond MaxConns block until a connection being
+// served finishes; a temporary Accept error triggers an exponential backoff
+// instead of aborting Serve. Once Shutdown or Close is called, Serve returns
+// ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	s.trackListener(l)
+	defer s.untrackListener(l)
+	var sem chan struct{}
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
+	var retryDelay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if retryDelay == 0 {
+					retryDelay = 5 * time.Millisecond
+				} else {
+					retryDelay *= 2
+				}
+				if max := time.Second; retryDelay > max {
+					retryDelay = max
+				}
+				if s.log != nil {
+					s.log.Printf("red: Accept error: %v; retrying in %v", err, retryDelay)
+				}
+				time.Sleep(retryDelay)
+				continue
+			}
 			return err
 		}
+		retryDelay = 0
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if s.TCPReadBuffer > 0 {
+				tc.SetReadBuffer(s.TCPReadBuffer)
+			}
+			if s.TCPWriteBuffer > 0 {
+				tc.SetWriteBuffer(s.TCPWriteBuffer)
+			}
+		}
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		go func(c net.Conn) {
+			if sem != nil {
+				defer func() { <-sem }()
+			}
 			switch err := s.HandleConn(c); err {
 			case nil, io.EOF:
 			default:
@@ -189,6 +940,14 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// deadlineSetter is implemented by connections that support read/write
+// deadlines, such as *net.TCPConn and *tls.Conn. HandleConn uses it to
+// implement ReadTimeout, WriteTimeout and IdleTimeout when conn supports it.
+type deadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
 // Logger is a set of methods used to log information. *log.Logger implements
 // this interface.
 type Logger interface {
@@ -205,6 +964,18 @@ func (noopLogger) Println(v ...interface{})               {}
 
 func errNoCmd(name string) resp.Error { return resp.Error("ERR unknown command '" + name + "'") }
 
+// watchStillValid reports whether every key in watched still has the
+// version recorded when it was snapshotted by WATCH. An empty or nil
+// watched set is trivially valid.
+func watchStillValid(kv KeyVersioner, watched map[string]uint64) bool {
+	for key, ver := range watched {
+		if kv.Version(key) != ver {
+			return false
+		}
+	}
+	return true
+}
+
 // ErrWrongArgs are expected to be returned by HandlerFunc implementations when
 // number of arguments are wrong. This error is automatically passed to client
 // with command name annotated.
@@ -238,9 +1009,10 @@ func singleVal(h HandlerFunc, r Request) interface{} {
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
 // connections. It's used by ListenAndServe and ListenAndServeTLS so
 // dead TCP connections (e.g. closing laptop mid-download) eventually
-// go away.
+// go away. A zero period falls back to a 3 minute default.
 type tcpKeepAliveListener struct {
 	*net.TCPListener
+	period time.Duration
 }
 
 func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
@@ -249,6 +1021,10 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 		return
 	}
 	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(3 * time.Minute)
+	period := ln.period
+	if period == 0 {
+		period = 3 * time.Minute
+	}
+	tc.SetKeepAlivePeriod(period)
 	return tc, nil
 }
@@ -0,0 +1,86 @@
+package red
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/artyom/resp"
+)
+
+// memVersioner is a minimal in-memory KeyVersioner for tests.
+type memVersioner struct {
+	mu   sync.Mutex
+	vers map[string]uint64
+}
+
+func (m *memVersioner) Version(key string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.vers[key]
+}
+
+func (m *memVersioner) Bump(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vers == nil {
+		m.vers = make(map[string]uint64)
+	}
+	for _, k := range keys {
+		m.vers[k]++
+	}
+}
+
+func TestExecWatchConflict(t *testing.T) {
+	kv := &memVersioner{}
+	srv := NewServer()
+	srv.WithKeyVersioner(kv)
+	var called int
+	srv.Handle("ping", func(req Request) (interface{}, error) {
+		called++
+		return "PONG", nil
+	})
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { srv.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, "*2\r\n$5\r\nWATCH\r\n$3\r\nfoo\r\n")
+	if _, err := resp.Decode(r); err != nil {
+		t.Fatalf("WATCH reply: %v", err)
+	}
+
+	// Simulate a conflicting write from another client/goroutine between
+	// WATCH and EXEC.
+	kv.Bump("foo")
+
+	fmt.Fprintf(conn, "*1\r\n$5\r\nMULTI\r\n")
+	if _, err := resp.Decode(r); err != nil {
+		t.Fatalf("MULTI reply: %v", err)
+	}
+	fmt.Fprintf(conn, "*1\r\n$4\r\nPING\r\n")
+	if _, err := resp.Decode(r); err != nil {
+		t.Fatalf("queued PING reply: %v", err)
+	}
+	fmt.Fprintf(conn, "*1\r\n$4\r\nEXEC\r\n")
+	v, err := resp.Decode(r)
+	if err != nil {
+		t.Fatalf("EXEC reply: %v", err)
+	}
+	if ar, ok := v.(resp.Array); !ok || ar != nil {
+		t.Fatalf("EXEC reply = %#v, want a RESP Null Array", v)
+	}
+	if called != 0 {
+		t.Fatalf("queued PING handler ran %d times, want 0 (EXEC must skip it on a watch conflict)", called)
+	}
+}